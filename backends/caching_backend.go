@@ -0,0 +1,203 @@
+package backends
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cachingBackendDefaultTTL  = 30 * time.Second
+	cachingBackendDefaultSize = 1000
+)
+
+// cacheEntry is the value stored in a ttlLRU: a cached auth/acl decision
+// together with the time at which it stops being valid.
+type cacheEntry struct {
+	value     bool
+	expiresAt time.Time
+}
+
+// ttlLRU is a fixed-size, least-recently-used cache where every entry also
+// carries its own expiry, so a cached answer is only ever served while
+// within both the size and TTL bounds.
+type ttlLRU struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	items   map[string]*list.Element
+	order   *list.List
+}
+
+type ttlLRUElement struct {
+	key   string
+	entry cacheEntry
+}
+
+func newTTLLRU(maxSize int, ttl time.Duration) *ttlLRU {
+	return &ttlLRU{
+		ttl:     ttl,
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *ttlLRU) get(key string) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return false, false
+	}
+
+	entry := el.Value.(*ttlLRUElement).entry
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return false, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *ttlLRU) set(key string, value bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := cacheEntry{value: value, expiresAt: time.Now().Add(c.ttl)}
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*ttlLRUElement).entry = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	el := c.order.PushFront(&ttlLRUElement{key: key, entry: entry})
+	c.items[key] = el
+
+	if c.maxSize > 0 && c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.items, oldest.Value.(*ttlLRUElement).key)
+		}
+	}
+}
+
+// pgBackend is the subset of Postgres that CachingBackend wraps, kept
+// narrow so the cache can be unit tested against anything that looks like
+// the backend rather than a full Postgres instance.
+type pgBackend interface {
+	GetUser(username, password string) bool
+	GetSuperuser(username string) bool
+	CheckAcl(username, topic, clientid string, acc int32) bool
+	Halt()
+}
+
+// CachingBackend wraps a Postgres backend with an in-process, per-entry
+// expiring LRU so that auth and ACL decisions don't round-trip to Postgres
+// for every broker check. Configure it with pg_cache_ttl (seconds) and
+// pg_cache_size (max entries per cache).
+type CachingBackend struct {
+	backend pgBackend
+
+	userCache  *ttlLRU
+	superCache *ttlLRU
+	aclCache   *ttlLRU
+}
+
+// NewCachingBackend builds a CachingBackend in front of backend, reading
+// pg_cache_ttl and pg_cache_size from authOpts (defaulting to 30s/1000
+// entries when unset).
+func NewCachingBackend(backend pgBackend, authOpts map[string]string) (*CachingBackend, error) {
+	ttl := cachingBackendDefaultTTL
+	if raw, ok := authOpts["pg_cache_ttl"]; ok && raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("caching backend error: invalid pg_cache_ttl %q: %s", raw, err)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	size := cachingBackendDefaultSize
+	if raw, ok := authOpts["pg_cache_size"]; ok && raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("caching backend error: invalid pg_cache_size %q: %s", raw, err)
+		}
+		size = parsed
+	}
+
+	return &CachingBackend{
+		backend:    backend,
+		userCache:  newTTLLRU(size, ttl),
+		superCache: newTTLLRU(size, ttl),
+		aclCache:   newTTLLRU(size, ttl),
+	}, nil
+}
+
+// userCacheKey hashes the attempted password so plaintext passwords are
+// never held in the cache, while still distinguishing cache entries by
+// which password was tried for a given username.
+func userCacheKey(username, password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return username + "\x00" + hex.EncodeToString(sum[:])
+}
+
+func aclCacheKey(username, topic, clientid string, acc int32) string {
+	return strings.Join([]string{username, topic, clientid, strconv.Itoa(int(acc))}, "\x00")
+}
+
+// GetUser returns the cached authentication result for username/password if
+// present and unexpired, otherwise falls through to the wrapped backend and
+// caches its answer.
+func (c *CachingBackend) GetUser(username, password string) bool {
+	key := userCacheKey(username, password)
+	if value, ok := c.userCache.get(key); ok {
+		return value
+	}
+
+	value := c.backend.GetUser(username, password)
+	c.userCache.set(key, value)
+	return value
+}
+
+// GetSuperuser returns the cached superuser result for username if present
+// and unexpired, otherwise falls through to the wrapped backend and caches
+// its answer.
+func (c *CachingBackend) GetSuperuser(username string) bool {
+	if value, ok := c.superCache.get(username); ok {
+		return value
+	}
+
+	value := c.backend.GetSuperuser(username)
+	c.superCache.set(username, value)
+	return value
+}
+
+// CheckAcl returns the cached ACL decision for (username, topic, clientid,
+// acc) if present and unexpired, otherwise falls through to the wrapped
+// backend and caches its answer.
+func (c *CachingBackend) CheckAcl(username, topic, clientid string, acc int32) bool {
+	key := aclCacheKey(username, topic, clientid, acc)
+	if value, ok := c.aclCache.get(key); ok {
+		return value
+	}
+
+	value := c.backend.CheckAcl(username, topic, clientid, acc)
+	c.aclCache.set(key, value)
+	return value
+}
+
+// Halt tears down the wrapped backend.
+func (c *CachingBackend) Halt() {
+	c.backend.Halt()
+}
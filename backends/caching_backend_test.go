@@ -0,0 +1,80 @@
+package backends
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCachingBackend(t *testing.T) {
+
+	authOpts := make(map[string]string)
+	authOpts["pg_host"] = "localhost"
+	authOpts["pg_port"] = "5432"
+	authOpts["pg_dbname"] = "go_auth_test"
+	authOpts["pg_user"] = "go_auth_test"
+	authOpts["pg_password"] = "go_auth_test"
+	authOpts["pg_userquery"] = "SELECT password_hash FROM test_user WHERE username = $1 limit 1"
+	authOpts["pg_superquery"] = "select count(*) from test_user where username = $1 and is_admin = true"
+	authOpts["pg_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = $1 AND test_acl.test_user_id = test_user.id AND (rw = $2 or rw = 3)"
+	authOpts["pg_cache_ttl"] = "60"
+	authOpts["pg_cache_size"] = "100"
+
+	Convey("Given a CachingBackend wrapping Postgres", t, func() {
+		postgres, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		caching, err := NewCachingBackend(postgres, authOpts)
+		So(err, ShouldBeNil)
+
+		//Empty db
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		username := "test"
+		userPass := "testpw"
+		userPassHash := "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
+
+		insertQuery := "INSERT INTO test_user(username, password_hash, is_admin) values($1, $2, $3) returning id"
+		userID := 0
+		iqErr := postgres.DB.Get(&userID, insertQuery, username, userPassHash, true)
+		So(iqErr, ShouldBeNil)
+
+		topic := "test/topic/1"
+		clientID := "test_client"
+		aclQuery := "INSERT INTO test_acl(test_user_id, topic, rw) values($1, $2, $3) returning id"
+		aclID := 0
+		aqErr := postgres.DB.Get(&aclID, aclQuery, userID, topic, 1)
+		So(aqErr, ShouldBeNil)
+
+		Convey("Warming the cache and then closing the DB, cached answers should still resolve", func() {
+			// Rewrap the cache around a backend of its own, so closing that
+			// backend's DB leaves postgres.DB open for the cleanup below.
+			backend, err := NewPostgres(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			caching, err = NewCachingBackend(backend, authOpts)
+			So(err, ShouldBeNil)
+
+			So(caching.GetUser(username, userPass), ShouldBeTrue)
+			So(caching.GetSuperuser(username), ShouldBeTrue)
+			So(caching.CheckAcl(username, topic, clientID, 1), ShouldBeTrue)
+
+			backend.DB.Close()
+
+			So(caching.GetUser(username, userPass), ShouldBeTrue)
+			So(caching.GetSuperuser(username), ShouldBeTrue)
+			So(caching.CheckAcl(username, topic, clientID, 1), ShouldBeTrue)
+
+			backend.Halt()
+		})
+
+		//Empty db
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		postgres.Halt()
+	})
+
+}
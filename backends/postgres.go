@@ -0,0 +1,656 @@
+package backends
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	pgDefaultHost = "localhost"
+	pgDefaultPort = "5432"
+
+	// backoff bounds used while a host is unhealthy.
+	pgMinBackoff = 500 * time.Millisecond
+	pgMaxBackoff = 30 * time.Second
+)
+
+// pgConn wraps a single Postgres connection (primary or replica) along with
+// the health state used for failover.
+type pgConn struct {
+	addr string
+	db   *sqlx.DB
+
+	mu      sync.RWMutex
+	healthy bool
+	backoff time.Duration
+
+	userStmt  *sqlx.Stmt
+	superStmt *sqlx.Stmt
+	aclStmt   *sqlx.Stmt
+
+	stopHealthCheck chan struct{}
+}
+
+func (c *pgConn) stmtFor(kind pgQueryKind) *sqlx.Stmt {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	switch kind {
+	case pgQueryUser:
+		return c.userStmt
+	case pgQuerySuper:
+		return c.superStmt
+	case pgQueryAcl:
+		return c.aclStmt
+	default:
+		return nil
+	}
+}
+
+// setStmts atomically swaps in the prepared statements for conn, replacing
+// whatever was prepared before (if anything).
+func (c *pgConn) setStmts(userStmt, superStmt, aclStmt *sqlx.Stmt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.userStmt = userStmt
+	c.superStmt = superStmt
+	c.aclStmt = aclStmt
+}
+
+// stmts returns the connection's prepared statements, for callers (like
+// Halt) that need to close all of them together.
+func (c *pgConn) stmts() [3]*sqlx.Stmt {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return [3]*sqlx.Stmt{c.userStmt, c.superStmt, c.aclStmt}
+}
+
+func (c *pgConn) getDB() *sqlx.DB {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.db
+}
+
+func (c *pgConn) setDB(db *sqlx.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.db = db
+}
+
+// pgQueryKind identifies which of the three configured queries a read is
+// running, so withReadConn can pick the matching prepared statement.
+type pgQueryKind int
+
+const (
+	pgQueryUser pgQueryKind = iota
+	pgQuerySuper
+	pgQueryAcl
+)
+
+func (c *pgConn) setHealthy(healthy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.healthy = healthy
+}
+
+func (c *pgConn) isHealthy() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.healthy
+}
+
+// Postgres holds all fields of the Postgres backend.
+type Postgres struct {
+	Host           string
+	Port           string
+	DBName         string
+	User           string
+	Password       string
+	UserQuery      string
+	SuperuserQuery string
+	AclQuery       string
+	SSLMode        string
+	SSLCert        string
+	SSLKey         string
+	SSLRootCert    string
+
+	// DB points at the primary connection and is kept for backwards
+	// compatibility with callers/tests that reach into it directly.
+	DB *sqlx.DB
+
+	primary     *pgConn
+	replicas    []*pgConn
+	useReplicas bool
+	rrCounter   uint64
+
+	preparedStatements bool
+	queryTimeout       time.Duration
+
+	logLevel log.Level
+}
+
+func checkPostgresMandatoryOptions(authOpts map[string]string) error {
+	for _, opt := range []string{"pg_dbname", "pg_user", "pg_password", "pg_userquery"} {
+		if authOpts[opt] == "" {
+			return fmt.Errorf("postgres backend error: missing mandatory option %s", opt)
+		}
+	}
+	return nil
+}
+
+// parsePgHosts reads pg_hosts (a comma separated list of host:port pairs) if
+// present, falling back to the single pg_host/pg_port pair for backwards
+// compatibility.
+func parsePgHosts(authOpts map[string]string) []string {
+	if raw, ok := authOpts["pg_hosts"]; ok && strings.TrimSpace(raw) != "" {
+		var addrs []string
+		for _, addr := range strings.Split(raw, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			if !strings.Contains(addr, ":") {
+				addr = fmt.Sprintf("%s:%s", addr, pgDefaultPort)
+			}
+			addrs = append(addrs, addr)
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+
+	host := authOpts["pg_host"]
+	if host == "" {
+		host = pgDefaultHost
+	}
+	port := authOpts["pg_port"]
+	if port == "" {
+		port = pgDefaultPort
+	}
+	return []string{fmt.Sprintf("%s:%s", host, port)}
+}
+
+// NewPostgres initializes a Postgres backend, opening a connection to every
+// host in pg_hosts (or pg_host/pg_port). When pg_read_replicas is true, all
+// hosts after the first are treated as read replicas: GetUser, GetSuperuser
+// and CheckAcl are load balanced across them, with automatic failover back
+// to the primary (or a sibling replica) if a host becomes unreachable.
+func NewPostgres(authOpts map[string]string, logLevel log.Level) (*Postgres, error) {
+
+	var postgres = &Postgres{
+		Host:           pgDefaultHost,
+		Port:           pgDefaultPort,
+		SSLMode:        "disable",
+		UserQuery:      "",
+		SuperuserQuery: "",
+		AclQuery:       "",
+		logLevel:       logLevel,
+	}
+
+	if err := checkPostgresMandatoryOptions(authOpts); err != nil {
+		return postgres, err
+	}
+
+	postgres.DBName = authOpts["pg_dbname"]
+	postgres.User = authOpts["pg_user"]
+	postgres.Password = authOpts["pg_password"]
+	postgres.UserQuery = authOpts["pg_userquery"]
+
+	if authOpts["pg_superquery"] != "" {
+		postgres.SuperuserQuery = authOpts["pg_superquery"]
+	}
+
+	if authOpts["pg_aclquery"] != "" {
+		postgres.AclQuery = authOpts["pg_aclquery"]
+	}
+
+	if sslmode, ok := authOpts["pg_sslmode"]; ok && sslmode != "" {
+		postgres.SSLMode = sslmode
+	}
+
+	postgres.SSLCert = authOpts["pg_sslcert"]
+	postgres.SSLKey = authOpts["pg_sslkey"]
+	postgres.SSLRootCert = authOpts["pg_sslrootcert"]
+
+	postgres.useReplicas = authOpts["pg_read_replicas"] == "true"
+	postgres.preparedStatements = authOpts["pg_prepared_statements"] == "true"
+
+	if rawTimeout, ok := authOpts["pg_query_timeout"]; ok && rawTimeout != "" {
+		seconds, err := strconv.Atoi(rawTimeout)
+		if err != nil {
+			return postgres, fmt.Errorf("postgres backend error: invalid pg_query_timeout %q: %s", rawTimeout, err)
+		}
+		postgres.queryTimeout = time.Duration(seconds) * time.Second
+	}
+
+	addrs := parsePgHosts(authOpts)
+	postgres.Host, postgres.Port = splitAddr(addrs[0])
+
+	conns := make([]*pgConn, 0, len(addrs))
+	for _, addr := range addrs {
+		conn, err := postgres.connectAddr(addr)
+		if err != nil {
+			// A host that's down at boot isn't fatal: mark it unhealthy and
+			// let the health checker bring it back once it's reachable.
+			log.Errorf("postgres backend: initial connection to %s failed: %s", addr, err)
+			conn = &pgConn{addr: addr, healthy: false, backoff: pgMinBackoff}
+		}
+		postgres.startHealthCheck(conn)
+		conns = append(conns, conn)
+	}
+
+	postgres.primary = conns[0]
+	postgres.DB = postgres.primary.getDB()
+
+	// Keep every extra host so Halt can close it; readConns only reads from
+	// them when pg_read_replicas is true.
+	if len(conns) > 1 {
+		postgres.replicas = conns[1:]
+	}
+
+	return postgres, nil
+}
+
+func splitAddr(addr string) (string, string) {
+	parts := strings.SplitN(addr, ":", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], pgDefaultPort
+}
+
+func (o *Postgres) connectAddr(addr string) (*pgConn, error) {
+	host, port := splitAddr(addr)
+
+	dsn, err := o.buildDSN(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("postgres backend error: couldn't open connection to %s: %s", addr, err)
+	}
+
+	conn := &pgConn{addr: addr, db: db, healthy: true, backoff: pgMinBackoff}
+
+	if o.preparedStatements {
+		if err := o.prepareConn(conn); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// prepareConn prepares the configured user/super/acl queries on conn,
+// reusing the resulting *sqlx.Stmt handles instead of re-parsing SQL on
+// every GetUser/GetSuperuser/CheckAcl call.
+func (o *Postgres) prepareConn(conn *pgConn) error {
+	var userStmt, superStmt, aclStmt *sqlx.Stmt
+	var err error
+
+	db := conn.getDB()
+
+	if o.UserQuery != "" {
+		if userStmt, err = db.Preparex(o.UserQuery); err != nil {
+			return fmt.Errorf("postgres backend error: couldn't prepare pg_userquery on %s: %s", conn.addr, err)
+		}
+	}
+
+	if o.SuperuserQuery != "" {
+		if superStmt, err = db.Preparex(o.SuperuserQuery); err != nil {
+			return fmt.Errorf("postgres backend error: couldn't prepare pg_superquery on %s: %s", conn.addr, err)
+		}
+	}
+
+	if o.AclQuery != "" {
+		if aclStmt, err = db.Preparex(o.AclQuery); err != nil {
+			return fmt.Errorf("postgres backend error: couldn't prepare pg_aclquery on %s: %s", conn.addr, err)
+		}
+	}
+
+	conn.setStmts(userStmt, superStmt, aclStmt)
+	return nil
+}
+
+func (o *Postgres) buildDSN(host, port string) (string, error) {
+	dsn := fmt.Sprintf("dbname=%s user=%s password=%s host=%s port=%s sslmode=%s",
+		o.DBName, o.User, o.Password, host, port, o.SSLMode)
+
+	if o.SSLCert != "" {
+		dsn += fmt.Sprintf(" sslcert=%s", o.SSLCert)
+	}
+	if o.SSLKey != "" {
+		dsn += fmt.Sprintf(" sslkey=%s", o.SSLKey)
+	}
+	if o.SSLRootCert != "" {
+		dsn += fmt.Sprintf(" sslrootcert=%s", o.SSLRootCert)
+	}
+
+	return dsn, nil
+}
+
+// startHealthCheck launches a goroutine that periodically pings conn while
+// it's unhealthy, backing off exponentially between attempts up to
+// pgMaxBackoff. It's a no-op once the connection is closed via Halt.
+func (o *Postgres) startHealthCheck(conn *pgConn) {
+	conn.stopHealthCheck = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(pgMinBackoff)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-conn.stopHealthCheck:
+				return
+			case <-ticker.C:
+				if conn.isHealthy() {
+					ticker.Reset(pgMinBackoff)
+					continue
+				}
+
+				if conn.getDB() == nil {
+					host, port := splitAddr(conn.addr)
+					dsn, err := o.buildDSN(host, port)
+					if err == nil {
+						if db, err := sqlx.Connect("postgres", dsn); err == nil {
+							conn.setDB(db)
+							if o.preparedStatements {
+								if err := o.prepareConn(conn); err != nil {
+									log.Errorf("postgres backend: %s", err)
+								}
+							}
+						}
+					}
+				}
+
+				if db := conn.getDB(); db != nil && db.Ping() == nil {
+					log.Infof("postgres backend: connection to %s recovered", conn.addr)
+					conn.setHealthy(true)
+					conn.backoff = pgMinBackoff
+					ticker.Reset(pgMinBackoff)
+					continue
+				}
+
+				conn.mu.Lock()
+				conn.backoff *= 2
+				if conn.backoff > pgMaxBackoff {
+					conn.backoff = pgMaxBackoff
+				}
+				backoff := conn.backoff
+				conn.mu.Unlock()
+				ticker.Reset(backoff)
+			}
+		}
+	}()
+}
+
+// readConns returns the pool that read queries (GetUser, GetSuperuser,
+// CheckAcl) should be tried against, healthy replicas first and the primary
+// last, so the primary is the last resort when no replica answers.
+func (o *Postgres) readConns() []*pgConn {
+	if !o.useReplicas || len(o.replicas) == 0 {
+		return []*pgConn{o.primary}
+	}
+
+	healthy := make([]*pgConn, 0, len(o.replicas))
+	for _, r := range o.replicas {
+		if r.isHealthy() {
+			healthy = append(healthy, r)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return []*pgConn{o.primary}
+	}
+
+	// Round robin across the healthy replicas, falling back to the primary
+	// if every pick we try in order turns out to be down mid-query.
+	start := int(atomic.AddUint64(&o.rrCounter, 1)) % len(healthy)
+	ordered := append(append([]*pgConn{}, healthy[start:]...), healthy[:start]...)
+	return append(ordered, o.primary)
+}
+
+// withReadConn runs fn against each candidate read connection in turn,
+// failing over to the next one if the query errors out (e.g. the host went
+// away mid-query, or it didn't respond within pg_query_timeout), and
+// marking failed connections unhealthy so the health checker takes over.
+// fn is handed the connection's prepared statement for kind when
+// pg_prepared_statements is enabled, or nil otherwise. Each attempt gets its
+// own fresh pg_query_timeout budget, so a slow/dead host doesn't eat into
+// the time available to try its siblings.
+//
+// sql.ErrNoRows is a normal "no such user/acl" result, not a sign the host
+// is down, so it's returned straight to the caller without marking the
+// connection unhealthy or trying a sibling.
+func (o *Postgres) withReadConn(kind pgQueryKind, fn func(ctx context.Context, db *sqlx.DB, stmt *sqlx.Stmt) error) error {
+	var lastErr error
+
+	for _, conn := range o.readConns() {
+		db := conn.getDB()
+		if db == nil || !conn.isHealthy() {
+			lastErr = fmt.Errorf("postgres backend: %s is unavailable", conn.addr)
+			continue
+		}
+
+		err := func() error {
+			ctx, cancel := o.queryContext()
+			defer cancel()
+			return fn(ctx, db, conn.stmtFor(kind))
+		}()
+		if err == nil {
+			return nil
+		}
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		log.Warnf("postgres backend: query against %s failed, failing over: %s", conn.addr, err)
+		conn.setHealthy(false)
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("postgres backend: no healthy connection available")
+	}
+	return lastErr
+}
+
+// queryContext returns a context bounded by pg_query_timeout, or
+// context.Background() (no deadline) when it's unset.
+func (o *Postgres) queryContext() (context.Context, context.CancelFunc) {
+	if o.queryTimeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), o.queryTimeout)
+}
+
+// GetUser checks that the given password matches the hash for the given
+// username, trying every read connection in turn before giving up.
+func (o *Postgres) GetUser(username, password string) bool {
+	var passwordHash string
+
+	err := o.withReadConn(pgQueryUser, func(ctx context.Context, db *sqlx.DB, stmt *sqlx.Stmt) error {
+		if stmt != nil {
+			return stmt.GetContext(ctx, &passwordHash, username)
+		}
+		return db.GetContext(ctx, &passwordHash, o.UserQuery, username)
+	})
+	if err != nil {
+		return false
+	}
+
+	return hashCompare(password, passwordHash)
+}
+
+// GetSuperuser checks if the given user is a superuser.
+func (o *Postgres) GetSuperuser(username string) bool {
+	if o.SuperuserQuery == "" {
+		return false
+	}
+
+	var count sql.NullInt64
+
+	err := o.withReadConn(pgQuerySuper, func(ctx context.Context, db *sqlx.DB, stmt *sqlx.Stmt) error {
+		if stmt != nil {
+			return stmt.GetContext(ctx, &count, username)
+		}
+		return db.GetContext(ctx, &count, o.SuperuserQuery, username)
+	})
+	if err != nil {
+		return false
+	}
+
+	return count.Valid && count.Int64 > 0
+}
+
+// CheckAcl checks if the given user has permission to access the given
+// topic for the given client id and access type (acc).
+func (o *Postgres) CheckAcl(username, topic, clientid string, acc int32) bool {
+	if o.AclQuery == "" {
+		return true
+	}
+
+	var acls []string
+
+	err := o.withReadConn(pgQueryAcl, func(ctx context.Context, db *sqlx.DB, stmt *sqlx.Stmt) error {
+		if stmt != nil {
+			return stmt.SelectContext(ctx, &acls, username, acc)
+		}
+		return db.SelectContext(ctx, &acls, o.AclQuery, username, acc)
+	})
+	if err != nil {
+		return false
+	}
+
+	for _, acl := range acls {
+		if topicsMatch(acl, topic, username, clientid) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Halt closes every connection (primary and replicas) and stops their
+// health check goroutines.
+func (o *Postgres) Halt() {
+	conns := append([]*pgConn{o.primary}, o.replicas...)
+	for _, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		close(conn.stopHealthCheck)
+		for _, stmt := range conn.stmts() {
+			if stmt != nil {
+				stmt.Close()
+			}
+		}
+		if db := conn.getDB(); db != nil {
+			if err := db.Close(); err != nil {
+				log.Errorf("postgres backend: error closing connection to %s: %s", conn.addr, err)
+			}
+		}
+	}
+}
+
+// hashCompare checks a plaintext password against a PBKDF2 hash of the form
+// PBKDF2$<hash func>$<iterations>$<salt>$<hash>, as produced by the go-auth
+// pw utility.
+func hashCompare(password, passwordHash string) bool {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 5 || parts[0] != "PBKDF2" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	var derived []byte
+	switch parts[1] {
+	case "sha512":
+		derived = pbkdf2.Key([]byte(password), salt, iterations, len(expected), sha512.New)
+	case "sha256":
+		derived = pbkdf2.Key([]byte(password), salt, iterations, len(expected), sha256.New)
+	default:
+		return false
+	}
+
+	if len(derived) != len(expected) {
+		return false
+	}
+
+	var diff byte
+	for i := range derived {
+		diff |= derived[i] ^ expected[i]
+	}
+
+	return diff == 0
+}
+
+// topicsMatch checks topic against an acl pattern stored in the db,
+// expanding %u and %c placeholders and supporting the + and # mosquitto
+// wildcards.
+func topicsMatch(acl, topic, username, clientid string) bool {
+	acl = strings.Replace(acl, "%u", username, -1)
+	acl = strings.Replace(acl, "%c", clientid, -1)
+
+	if acl == topic {
+		return true
+	}
+
+	aclLevels := strings.Split(acl, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range aclLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level == "+" {
+			continue
+		}
+
+		if level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(aclLevels) == len(topicLevels)
+}
+
@@ -2,6 +2,7 @@ package backends
 
 import (
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
@@ -163,3 +164,147 @@ func TestPostgres(t *testing.T) {
 	})
 
 }
+
+func TestPostgresFailover(t *testing.T) {
+
+	authOpts := make(map[string]string)
+	authOpts["pg_hosts"] = "localhost:5432,localhost:5432"
+	authOpts["pg_read_replicas"] = "true"
+	authOpts["pg_dbname"] = "go_auth_test"
+	authOpts["pg_user"] = "go_auth_test"
+	authOpts["pg_password"] = "go_auth_test"
+	authOpts["pg_userquery"] = "SELECT password_hash FROM test_user WHERE username = $1 limit 1"
+	authOpts["pg_superquery"] = "select count(*) from test_user where username = $1 and is_admin = true"
+	authOpts["pg_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = $1 AND test_acl.test_user_id = test_user.id AND (rw = $2 or rw = 3)"
+
+	Convey("Given a pg_hosts list with a replica, NewPostgres should connect to both", t, func() {
+		postgres, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(postgres.primary, ShouldNotBeNil)
+		So(postgres.replicas, ShouldHaveLength, 1)
+
+		//Empty db
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		username := "test"
+		userPass := "testpw"
+		userPassHash := "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
+
+		insertQuery := "INSERT INTO test_user(username, password_hash, is_admin) values($1, $2, $3) returning id"
+		userID := 0
+		iqErr := postgres.DB.Get(&userID, insertQuery, username, userPassHash, true)
+		So(iqErr, ShouldBeNil)
+
+		Convey("Given a healthy replica, GetUser should succeed against it", func() {
+			authenticated := postgres.GetUser(username, userPass)
+			So(authenticated, ShouldBeTrue)
+		})
+
+		Convey("Given a replica that goes away mid-query, GetUser should fail over to the primary", func() {
+			replica := postgres.replicas[0]
+			// Close the replica's connection without marking it unhealthy,
+			// so the query against it fails mid-flight and withReadConn has
+			// to fail over to the primary itself.
+			replica.getDB().Close()
+
+			authenticated := postgres.GetUser(username, userPass)
+			So(authenticated, ShouldBeTrue)
+			So(replica.isHealthy(), ShouldBeFalse)
+		})
+
+		//Empty db
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		postgres.Halt()
+	})
+
+}
+
+func TestPostgresPreparedStatementsAndTimeouts(t *testing.T) {
+
+	authOpts := make(map[string]string)
+	authOpts["pg_host"] = "localhost"
+	authOpts["pg_port"] = "5432"
+	authOpts["pg_dbname"] = "go_auth_test"
+	authOpts["pg_user"] = "go_auth_test"
+	authOpts["pg_password"] = "go_auth_test"
+	authOpts["pg_userquery"] = "SELECT password_hash FROM test_user WHERE username = $1 limit 1"
+	authOpts["pg_superquery"] = "select count(*) from test_user where username = $1 and is_admin = true"
+	authOpts["pg_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = $1 AND test_acl.test_user_id = test_user.id AND (rw = $2 or rw = 3)"
+	authOpts["pg_prepared_statements"] = "true"
+
+	Convey("Given pg_prepared_statements, NewPostgres should prepare the configured queries once", t, func() {
+		postgres, err := NewPostgres(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(postgres.primary.userStmt, ShouldNotBeNil)
+		So(postgres.primary.superStmt, ShouldNotBeNil)
+		So(postgres.primary.aclStmt, ShouldNotBeNil)
+
+		//Empty db
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		username := "test"
+		userPass := "testpw"
+		userPassHash := "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
+
+		insertQuery := "INSERT INTO test_user(username, password_hash, is_admin) values($1, $2, $3) returning id"
+		userID := 0
+		iqErr := postgres.DB.Get(&userID, insertQuery, username, userPassHash, true)
+		So(iqErr, ShouldBeNil)
+
+		Convey("Queries should still succeed once statements are prepared", func() {
+			So(postgres.GetUser(username, userPass), ShouldBeTrue)
+			So(postgres.GetSuperuser(username), ShouldBeTrue)
+		})
+
+		//Empty db
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		postgres.Halt()
+	})
+
+	Convey("Given an unreachably short pg_query_timeout, a lookup should be denied rather than hang", t, func() {
+		timeoutOpts := make(map[string]string)
+		for k, v := range authOpts {
+			timeoutOpts[k] = v
+		}
+		timeoutOpts["pg_prepared_statements"] = "false"
+		timeoutOpts["pg_query_timeout"] = "0"
+
+		postgres, err := NewPostgres(timeoutOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		//Empty db
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		username := "test"
+		userPass := "testpw"
+		userPassHash := "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
+
+		insertQuery := "INSERT INTO test_user(username, password_hash, is_admin) values($1, $2, $3) returning id"
+		userID := 0
+		iqErr := postgres.DB.Get(&userID, insertQuery, username, userPassHash, true)
+		So(iqErr, ShouldBeNil)
+
+		// pg_query_timeout of 0 means "unset" (no deadline); simulate a hung
+		// query by setting a timeout that's already expired. The user row
+		// above exists, so a denial here is attributable to the timeout and
+		// not to a bare sql.ErrNoRows.
+		postgres.queryTimeout = time.Nanosecond
+
+		authenticated := postgres.GetUser(username, userPass)
+		So(authenticated, ShouldBeFalse)
+
+		//Empty db
+		postgres.DB.MustExec("delete from test_user where 1 = 1")
+		postgres.DB.MustExec("delete from test_acl where 1 = 1")
+
+		postgres.Halt()
+	})
+
+}